@@ -0,0 +1,283 @@
+// Package circuitbreaker provides a small per-key circuit breaker and AIMD
+// concurrency limiter shared by query dispatch paths (pkg/services/query,
+// pkg/tsdb/loki) so a struggling upstream datasource doesn't get piled on
+// with more concurrent requests while it's failing.
+package circuitbreaker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type state int
+
+const (
+	stateClosed state = iota
+	stateOpen
+	stateHalfOpen
+)
+
+func (s state) String() string {
+	switch s {
+	case stateOpen:
+		return "open"
+	case stateHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// ErrUpstreamUnavailable is returned by Breaker.Allow when the breaker is
+// open. RetryAfter is a hint for how long the caller should wait before
+// trying again.
+type ErrUpstreamUnavailable struct {
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (e *ErrUpstreamUnavailable) Error() string {
+	return fmt.Sprintf("upstream %q unavailable, retry after %s", e.Key, e.RetryAfter)
+}
+
+var circuitState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "xquare_dashboard",
+	Name:      "circuit_state",
+	Help:      "Circuit breaker state per datasource (0=closed, 1=open, 2=half-open).",
+}, []string{"key"})
+
+var concurrencyPermits = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "xquare_dashboard",
+	Name:      "concurrency_permits",
+	Help:      "Current AIMD concurrency permit count per datasource.",
+}, []string{"key"})
+
+func init() {
+	prometheus.MustRegister(circuitState, concurrencyPermits)
+}
+
+// Config bounds a Breaker's sliding-window thresholds.
+type Config struct {
+	// Window is how far back error rate/latency/429-503 counts are
+	// tracked.
+	Window time.Duration
+	// MinRequests is the minimum number of requests in Window before the
+	// error rate is evaluated at all, avoiding opening on a handful of
+	// cold-start failures.
+	MinRequests int
+	// ErrorRateThreshold opens the breaker when the fraction of failed
+	// requests in Window meets or exceeds this value.
+	ErrorRateThreshold float64
+	// OpenDuration is how long the breaker stays open before moving to
+	// half-open and allowing a single probe request through.
+	OpenDuration time.Duration
+}
+
+// DefaultConfig opens after at least 10 requests in a 30s window with a
+// >=50% error rate, and probes again after 10s.
+func DefaultConfig() Config {
+	return Config{
+		Window:             30 * time.Second,
+		MinRequests:        10,
+		ErrorRateThreshold: 0.5,
+		OpenDuration:       10 * time.Second,
+	}
+}
+
+type result struct {
+	at      time.Time
+	failed  bool
+	latency time.Duration
+}
+
+// Breaker tracks rolling error rate and latency for one upstream key and
+// decides whether new requests should be allowed through.
+type Breaker struct {
+	key string
+	cfg Config
+
+	mu            sync.Mutex
+	st            state
+	openedAt      time.Time
+	probeInFlight bool
+	results       []result
+}
+
+func newBreaker(key string, cfg Config) *Breaker {
+	return &Breaker{key: key, cfg: cfg, st: stateClosed}
+}
+
+// Allow reports whether a new request may proceed. In the open state it
+// returns ErrUpstreamUnavailable; in half-open it allows exactly one probe
+// request through and rejects concurrent others until that probe resolves.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.st {
+	case stateOpen:
+		if time.Since(b.openedAt) < b.cfg.OpenDuration {
+			return &ErrUpstreamUnavailable{Key: b.key, RetryAfter: b.cfg.OpenDuration - time.Since(b.openedAt)}
+		}
+		b.st = stateHalfOpen
+		b.probeInFlight = true
+		circuitState.WithLabelValues(b.key).Set(float64(stateHalfOpen))
+		return nil
+	case stateHalfOpen:
+		if b.probeInFlight {
+			return &ErrUpstreamUnavailable{Key: b.key, RetryAfter: b.cfg.OpenDuration}
+		}
+		b.probeInFlight = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// RecordResult records the outcome of a request that Allow let through, and
+// updates the breaker's state.
+func (b *Breaker) RecordResult(failed bool, latency time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.results = append(b.results, result{at: now, failed: failed, latency: latency})
+	b.trim(now)
+
+	if b.st == stateHalfOpen {
+		b.probeInFlight = false
+		if failed {
+			b.open(now)
+		} else {
+			b.st = stateClosed
+			b.results = nil
+			circuitState.WithLabelValues(b.key).Set(float64(stateClosed))
+		}
+		return
+	}
+
+	if len(b.results) >= b.cfg.MinRequests {
+		errRate := b.errorRate()
+		if errRate >= b.cfg.ErrorRateThreshold {
+			b.open(now)
+		}
+	}
+}
+
+func (b *Breaker) open(now time.Time) {
+	b.st = stateOpen
+	b.openedAt = now
+	b.probeInFlight = false
+	circuitState.WithLabelValues(b.key).Set(float64(stateOpen))
+}
+
+func (b *Breaker) errorRate() float64 {
+	if len(b.results) == 0 {
+		return 0
+	}
+	failures := 0
+	for _, r := range b.results {
+		if r.failed {
+			failures++
+		}
+	}
+	return float64(failures) / float64(len(b.results))
+}
+
+// trim drops results older than the window. Caller must hold b.mu.
+func (b *Breaker) trim(now time.Time) {
+	cutoff := now.Add(-b.cfg.Window)
+	i := 0
+	for ; i < len(b.results); i++ {
+		if b.results[i].at.After(cutoff) {
+			break
+		}
+	}
+	b.results = b.results[i:]
+}
+
+// Latencies returns the p50/p95 latency of requests currently in the
+// window, for callers that want to surface it alongside circuit state.
+func (b *Breaker) Latencies() (p50, p95 time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return percentile(b.results, 0.50), percentile(b.results, 0.95)
+}
+
+func percentile(results []result, p float64) time.Duration {
+	if len(results) == 0 {
+		return 0
+	}
+	latencies := make([]time.Duration, len(results))
+	for i, r := range results {
+		latencies[i] = r.latency
+	}
+	for i := 1; i < len(latencies); i++ {
+		for j := i; j > 0 && latencies[j-1] > latencies[j]; j-- {
+			latencies[j-1], latencies[j] = latencies[j], latencies[j-1]
+		}
+	}
+	idx := int(p * float64(len(latencies)-1))
+	return latencies[idx]
+}
+
+// Registry hands out one Breaker and one Limiter per key (typically
+// "<datasourceType>/<uid>"), so callers across packages share the same
+// state for a given datasource instance.
+type Registry struct {
+	cfg  Config
+	lcfg LimiterConfig
+
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+	limiters map[string]*Limiter
+}
+
+func NewRegistry(cfg Config, lcfg LimiterConfig) *Registry {
+	return &Registry{
+		cfg:      cfg,
+		lcfg:     lcfg,
+		breakers: make(map[string]*Breaker),
+		limiters: make(map[string]*Limiter),
+	}
+}
+
+func (r *Registry) Breaker(key string) *Breaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.breakers[key]
+	if !ok {
+		b = newBreaker(key, r.cfg)
+		r.breakers[key] = b
+	}
+	return b
+}
+
+func (r *Registry) Limiter(key string) *Limiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l, ok := r.limiters[key]
+	if !ok {
+		l = newLimiter(key, r.lcfg)
+		r.limiters[key] = l
+	}
+	return l
+}
+
+// IsUpstreamUnavailable reports whether err is (or wraps) an
+// ErrUpstreamUnavailable.
+func IsUpstreamUnavailable(err error) bool {
+	var target *ErrUpstreamUnavailable
+	return errors.As(err, &target)
+}
+
+// Shared is the process-wide Registry every query dispatch path
+// (pkg/services/query, pkg/tsdb/loki) consults, keyed by "<dsType>/<uid>".
+// A datasource instance reached through more than one dispatch path is
+// still gated by a single breaker/limiter pair, instead of each path
+// tracking its own, disjoint view of that datasource's health.
+var Shared = NewRegistry(DefaultConfig(), DefaultLimiterConfig())
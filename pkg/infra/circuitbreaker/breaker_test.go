@@ -0,0 +1,63 @@
+package circuitbreaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreaker_OpensAfterErrorRateThreshold(t *testing.T) {
+	cfg := Config{Window: time.Minute, MinRequests: 4, ErrorRateThreshold: 0.5, OpenDuration: time.Hour}
+	b := newBreaker("test", cfg)
+
+	require.NoError(t, b.Allow())
+	b.RecordResult(true, time.Millisecond)
+	require.NoError(t, b.Allow())
+	b.RecordResult(true, time.Millisecond)
+	require.NoError(t, b.Allow())
+	b.RecordResult(false, time.Millisecond)
+	require.NoError(t, b.Allow())
+	b.RecordResult(false, time.Millisecond)
+
+	err := b.Allow()
+	require.Error(t, err)
+	assert.True(t, IsUpstreamUnavailable(err))
+}
+
+func TestBreaker_HalfOpenAllowsSingleProbe(t *testing.T) {
+	cfg := Config{Window: time.Minute, MinRequests: 1, ErrorRateThreshold: 0.5, OpenDuration: time.Millisecond}
+	b := newBreaker("test", cfg)
+
+	require.NoError(t, b.Allow())
+	b.RecordResult(true, time.Millisecond)
+	require.Error(t, b.Allow()) // still within OpenDuration on the very first check
+
+	time.Sleep(2 * time.Millisecond)
+	require.NoError(t, b.Allow()) // half-open: first probe allowed
+	require.Error(t, b.Allow())   // second concurrent probe rejected
+
+	b.RecordResult(false, time.Millisecond)
+	require.NoError(t, b.Allow()) // closed again after a successful probe
+}
+
+func TestLimiter_AIMD(t *testing.T) {
+	l := newLimiter("test", LimiterConfig{Min: 2, Max: 20, Initial: 10})
+
+	l.OnSuccess()
+	assert.Equal(t, 11, l.Permits())
+
+	l.OnFailure()
+	assert.Equal(t, 5, l.Permits())
+
+	for i := 0; i < 10; i++ {
+		l.OnFailure()
+	}
+	assert.Equal(t, 2, l.Permits())
+
+	for i := 0; i < 30; i++ {
+		l.OnSuccess()
+	}
+	assert.Equal(t, 20, l.Permits())
+}
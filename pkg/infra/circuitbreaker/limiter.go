@@ -0,0 +1,76 @@
+package circuitbreaker
+
+import "sync"
+
+// LimiterConfig bounds an AIMD Limiter's permit count.
+type LimiterConfig struct {
+	Min int
+	Max int
+	// Initial is the starting permit count; clamped to [Min, Max].
+	Initial int
+}
+
+// DefaultLimiterConfig starts at the same concurrency Grafana previously
+// hard-coded (10), and lets it range between 2 and 50 permits.
+func DefaultLimiterConfig() LimiterConfig {
+	return LimiterConfig{Min: 2, Max: 50, Initial: 10}
+}
+
+// Limiter is an additive-increase/multiplicative-decrease concurrency
+// limiter: successful batches grow the permit count by one, a failure
+// (429/5xx/timeout) halves it, always clamped to [Min, Max].
+type Limiter struct {
+	key string
+	cfg LimiterConfig
+
+	mu      sync.Mutex
+	permits int
+}
+
+func newLimiter(key string, cfg LimiterConfig) *Limiter {
+	initial := cfg.Initial
+	if initial < cfg.Min {
+		initial = cfg.Min
+	}
+	if initial > cfg.Max {
+		initial = cfg.Max
+	}
+	l := &Limiter{key: key, cfg: cfg, permits: initial}
+	concurrencyPermits.WithLabelValues(key).Set(float64(initial))
+	return l
+}
+
+// Permits returns the current permit count, suitable for passing directly
+// as the concurrency argument to concurrency.ForEachJob.
+func (l *Limiter) Permits() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.permits
+}
+
+// OnSuccess additively increases the permit count by one, up to Max.
+func (l *Limiter) OnSuccess() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.permits < l.cfg.Max {
+		l.permits++
+		concurrencyPermits.WithLabelValues(l.key).Set(float64(l.permits))
+	}
+}
+
+// OnFailure multiplicatively decreases the permit count by half, down to
+// Min. Callers should call this once per batch that saw a 429/5xx/timeout,
+// not once per request, to avoid collapsing the limiter on a single slow
+// query in a large batch.
+func (l *Limiter) OnFailure() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	next := l.permits / 2
+	if next < l.cfg.Min {
+		next = l.cfg.Min
+	}
+	if next != l.permits {
+		l.permits = next
+		concurrencyPermits.WithLabelValues(l.key).Set(float64(l.permits))
+	}
+}
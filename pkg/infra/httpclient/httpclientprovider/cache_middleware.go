@@ -0,0 +1,268 @@
+package httpclientprovider
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	gocache "github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/xquare-dashboard/pkg/infra/log"
+)
+
+const CacheMiddlewareName = "cache"
+
+var cacheLogger = log.New("httpclientprovider.cache")
+
+var cacheOutcomesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "xquare_dashboard",
+	Name:      "http_client_cache_total",
+	Help:      "Number of requests handled by CacheMiddleware, by outcome (hit, miss, coalesced).",
+}, []string{"outcome"})
+
+func init() {
+	prometheus.MustRegister(cacheOutcomesTotal)
+}
+
+// cachedResponse is what we store per key: enough to reconstruct an
+// *http.Response without re-reading from the network.
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// Cache is the storage interface CacheMiddleware uses. The default is an
+// in-memory LRU-ish cache (patrickmn/go-cache); a Redis-backed
+// implementation can satisfy the same interface to share a cache across
+// multiple Grafana instances.
+type Cache interface {
+	Get(key string) (cachedResponse, bool)
+	Set(key string, value cachedResponse, ttl time.Duration)
+}
+
+// memoryCache is the default Cache, backed by github.com/patrickmn/go-cache.
+type memoryCache struct {
+	c *gocache.Cache
+}
+
+// NewMemoryCache creates the default in-memory Cache. defaultTTL/cleanup
+// follow go-cache's own semantics; per-Set TTLs override defaultTTL.
+func NewMemoryCache(defaultTTL, cleanupInterval time.Duration) Cache {
+	return &memoryCache{c: gocache.New(defaultTTL, cleanupInterval)}
+}
+
+func (m *memoryCache) Get(key string) (cachedResponse, bool) {
+	v, ok := m.c.Get(key)
+	if !ok {
+		return cachedResponse{}, false
+	}
+	res, ok := v.(cachedResponse)
+	return res, ok
+}
+
+func (m *memoryCache) Set(key string, value cachedResponse, ttl time.Duration) {
+	m.c.Set(key, value, ttl)
+}
+
+// CacheConfig configures CacheMiddleware.
+type CacheConfig struct {
+	// TTL is the cache lifetime used for requests with no time-bounded
+	// window of their own (e.g. labels/series/metadata resource calls).
+	TTL time.Duration
+	// MaxAge is how stale a time-bounded query's window must be before
+	// its result is eligible for caching at all: a query is cacheable
+	// only if now-End >= MaxAge, i.e. its window has settled.
+	MaxAge time.Duration
+}
+
+// DefaultCacheConfig caches metadata/label/series resource calls for one
+// minute, and caches time-bounded queries once their window is at least
+// five minutes stale.
+func DefaultCacheConfig() CacheConfig {
+	return CacheConfig{
+		TTL:    time.Minute,
+		MaxAge: 5 * time.Minute,
+	}
+}
+
+// CacheMiddleware wraps the transport with a response cache keyed by
+// method+URL+relevant headers+body, coalescing concurrent identical
+// requests with singleflight so a stampede only reaches upstream once.
+// Only GET requests are cached, since caching write/resource-mutating
+// calls would be unsafe.
+func CacheMiddleware(cfg CacheConfig, store Cache) sdkhttpclient.Middleware {
+	if store == nil {
+		store = NewMemoryCache(cfg.TTL, 2*cfg.TTL)
+	}
+	group := &singleflight.Group{}
+
+	return sdkhttpclient.NamedMiddlewareFunc(CacheMiddlewareName, func(opts sdkhttpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.Method != http.MethodGet || req.Header.Get("Cache-Control") == "no-cache" {
+				return next.RoundTrip(req)
+			}
+
+			ttl, cacheable := effectiveTTL(req, cfg)
+			if !cacheable {
+				return next.RoundTrip(req)
+			}
+
+			key, err := cacheKey(req)
+			if err != nil {
+				cacheLogger.Warn("Failed to compute cache key, bypassing cache", "error", err, "url", req.URL.String())
+				return next.RoundTrip(req)
+			}
+
+			if cached, ok := store.Get(key); ok {
+				cacheOutcomesTotal.WithLabelValues("hit").Inc()
+				return cachedToResponse(req, cached, "HIT"), nil
+			}
+
+			v, err, shared := group.Do(key, func() (interface{}, error) {
+				res, err := next.RoundTrip(req)
+				if err != nil {
+					return nil, err
+				}
+				cached, err := toCachedResponse(res)
+				if err != nil {
+					return nil, err
+				}
+				// Only cache successful responses. Storing a 5xx/429 would
+				// serve that error back for the full TTL on every
+				// subsequent request, defeating RetryMiddleware's retries
+				// on the very failures it exists to retry.
+				if cached.status >= 200 && cached.status < 300 {
+					store.Set(key, cached, ttl)
+				}
+				return cached, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			cached := v.(cachedResponse)
+			outcome, tag := "miss", "MISS"
+			if shared {
+				outcome, tag = "coalesced", "COALESCED"
+			}
+			cacheOutcomesTotal.WithLabelValues(outcome).Inc()
+			return cachedToResponse(req, cached, tag), nil
+		})
+	})
+}
+
+// effectiveTTL decides whether req is cacheable and, if so, the TTL to use.
+// Requests carrying an "end" query parameter are treated as time-bounded:
+// their TTL is capped to how stale their window already is
+// (min(cfg.TTL, now-End)), and they're only cacheable once that window has
+// settled by at least cfg.MaxAge. Requests with no "end" param (labels,
+// series, index/stats) use cfg.TTL directly.
+func effectiveTTL(req *http.Request, cfg CacheConfig) (time.Duration, bool) {
+	end, ok := queryEndTime(req)
+	if !ok {
+		return cfg.TTL, cfg.TTL > 0
+	}
+
+	age := time.Since(end)
+	if age < cfg.MaxAge {
+		return 0, false
+	}
+	ttl := cfg.TTL
+	if age < ttl {
+		ttl = age
+	}
+	return ttl, ttl > 0
+}
+
+func queryEndTime(req *http.Request) (time.Time, bool) {
+	raw := req.URL.Query().Get("end")
+	if raw == "" {
+		return time.Time{}, false
+	}
+	if t, ok := parseLokiTimestamp(raw); ok {
+		return t, true
+	}
+	if t, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// parseLokiTimestamp parses the numeric forms Loki's query/query_range "end"
+// (and "start") params accept: a nanosecond Unix epoch integer, which is
+// what Grafana's Loki datasource sends, or a Unix epoch in (possibly
+// fractional) seconds. The two are told apart by magnitude: a nanosecond
+// epoch for any date since 2001 has at least 18 digits, while a
+// seconds epoch stays at 10 digits until the year 2286 - treating a
+// nanosecond value as seconds would multiply it by 1e9 again and overflow
+// int64, or treating a seconds value as nanoseconds would round it to 1970.
+func parseLokiTimestamp(raw string) (time.Time, bool) {
+	if ns, err := strconv.ParseInt(raw, 10, 64); err == nil && len(raw) >= 18 {
+		return time.Unix(0, ns), true
+	}
+	if sec, err := strconv.ParseFloat(raw, 64); err == nil {
+		return time.Unix(0, int64(sec*float64(time.Second))), true
+	}
+	return time.Time{}, false
+}
+
+// cacheKey hashes method, URL, relevant headers and the request body so
+// identical requests (including identical query parameters) collapse to
+// the same key.
+func cacheKey(req *http.Request) (string, error) {
+	h := sha256.New()
+	h.Write([]byte(req.Method))
+	h.Write([]byte(req.URL.String()))
+	for _, name := range []string{"Authorization", "X-Scope-Orgid", "Accept"} {
+		h.Write([]byte(name))
+		h.Write([]byte(req.Header.Get(name)))
+	}
+
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return "", err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		h.Write(body)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func toCachedResponse(res *http.Response) (cachedResponse, error) {
+	var body []byte
+	if res.Body != nil {
+		var err error
+		body, err = io.ReadAll(res.Body)
+		if err != nil {
+			return cachedResponse{}, err
+		}
+		_ = res.Body.Close()
+		res.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	return cachedResponse{
+		status: res.StatusCode,
+		header: res.Header.Clone(),
+		body:   body,
+	}, nil
+}
+
+func cachedToResponse(req *http.Request, cached cachedResponse, cacheTag string) *http.Response {
+	header := cached.header.Clone()
+	header.Set("X-Cache", cacheTag)
+	return &http.Response{
+		Request:    req,
+		StatusCode: cached.status,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader(cached.body)),
+	}
+}
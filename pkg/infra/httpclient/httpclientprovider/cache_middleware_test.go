@@ -0,0 +1,147 @@
+package httpclientprovider
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRequest(t *testing.T, rawURL string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	require.NoError(t, err)
+	return req
+}
+
+func TestCacheMiddleware_HitsOnSecondRequest(t *testing.T) {
+	var calls int32
+	next := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("labels"))}, nil
+	})
+
+	mw := CacheMiddleware(DefaultCacheConfig(), NewMemoryCache(time.Minute, time.Minute))
+	rt := mw.CreateMiddleware(sdkhttpclient.Options{}, next)
+
+	res1, err := rt.RoundTrip(newTestRequest(t, "http://loki.example.com/loki/api/v1/labels"))
+	require.NoError(t, err)
+	assert.Equal(t, "MISS", res1.Header.Get("X-Cache"))
+
+	res2, err := rt.RoundTrip(newTestRequest(t, "http://loki.example.com/loki/api/v1/labels"))
+	require.NoError(t, err)
+	assert.Equal(t, "HIT", res2.Header.Get("X-Cache"))
+	assert.EqualValues(t, 1, calls)
+}
+
+func TestCacheMiddleware_RespectsNoCacheHeader(t *testing.T) {
+	var calls int32
+	next := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("labels"))}, nil
+	})
+
+	mw := CacheMiddleware(DefaultCacheConfig(), NewMemoryCache(time.Minute, time.Minute))
+	rt := mw.CreateMiddleware(sdkhttpclient.Options{}, next)
+
+	req := newTestRequest(t, "http://loki.example.com/loki/api/v1/labels")
+	req.Header.Set("Cache-Control", "no-cache")
+
+	_, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, calls)
+}
+
+func TestCacheMiddleware_CoalescesConcurrentRequests(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	next := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("labels"))}, nil
+	})
+
+	mw := CacheMiddleware(DefaultCacheConfig(), NewMemoryCache(time.Minute, time.Minute))
+	rt := mw.CreateMiddleware(sdkhttpclient.Options{}, next)
+
+	var wg sync.WaitGroup
+	tags := make([]string, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := rt.RoundTrip(newTestRequest(t, "http://loki.example.com/loki/api/v1/labels"))
+			require.NoError(t, err)
+			tags[i] = res.Header.Get("X-Cache")
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.EqualValues(t, 1, calls)
+	var coalesced int
+	for _, tag := range tags {
+		if tag == "COALESCED" {
+			coalesced++
+		}
+	}
+	assert.GreaterOrEqual(t, coalesced, 1)
+}
+
+func TestCacheMiddleware_DoesNotCacheErrorResponses(t *testing.T) {
+	var calls int32
+	next := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("unavailable"))}, nil
+	})
+
+	mw := CacheMiddleware(DefaultCacheConfig(), NewMemoryCache(time.Minute, time.Minute))
+	rt := mw.CreateMiddleware(sdkhttpclient.Options{}, next)
+
+	res1, err := rt.RoundTrip(newTestRequest(t, "http://loki.example.com/loki/api/v1/labels"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, res1.StatusCode)
+
+	res2, err := rt.RoundTrip(newTestRequest(t, "http://loki.example.com/loki/api/v1/labels"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, res2.StatusCode)
+	assert.EqualValues(t, 2, calls, "a 5xx response must not be served from cache")
+}
+
+func TestEffectiveTTL_TimeBoundedQuery(t *testing.T) {
+	cfg := CacheConfig{TTL: time.Hour, MaxAge: time.Minute}
+
+	stale := newTestRequest(t, "http://x/api/v1/query_range?end="+strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10))
+	ttl, ok := effectiveTTL(stale, cfg)
+	assert.True(t, ok)
+	assert.Less(t, ttl, cfg.TTL)
+
+	fresh := newTestRequest(t, "http://x/api/v1/query_range?end="+strconv.FormatInt(time.Now().Unix(), 10))
+	_, ok = effectiveTTL(fresh, cfg)
+	assert.False(t, ok)
+
+	noEnd := newTestRequest(t, "http://x/api/v1/labels")
+	ttl, ok = effectiveTTL(noEnd, cfg)
+	assert.True(t, ok)
+	assert.Equal(t, cfg.TTL, ttl)
+}
+
+func TestQueryEndTime_NanosecondEpoch(t *testing.T) {
+	want := time.Now().Add(-10 * time.Minute)
+	req := newTestRequest(t, "http://x/api/v1/query_range?end="+strconv.FormatInt(want.UnixNano(), 10))
+
+	got, ok := queryEndTime(req)
+	require.True(t, ok)
+	assert.WithinDuration(t, want, got, time.Second, "a Loki-style nanosecond epoch must not be mistaken for seconds")
+}
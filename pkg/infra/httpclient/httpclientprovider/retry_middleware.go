@@ -0,0 +1,305 @@
+package httpclientprovider
+
+import (
+	"context"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	"github.com/xquare-dashboard/pkg/infra/log"
+)
+
+const RetryMiddlewareName = "retry"
+
+var retryLogger = log.New("httpclientprovider.retry")
+
+var tracer = otel.Tracer("github.com/xquare-dashboard/pkg/infra/httpclient/httpclientprovider")
+
+var retriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "xquare_dashboard",
+	Name:      "http_client_retries_total",
+	Help:      "Number of HTTP request retry attempts made by RetryMiddleware, by outcome.",
+}, []string{"outcome"})
+
+func init() {
+	prometheus.MustRegister(retriesTotal)
+}
+
+// RetryConfig configures RetryMiddleware.
+type RetryConfig struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	// A value <= 1 disables retries.
+	MaxAttempts int
+	// InitialInterval is the backoff before the first retry.
+	InitialInterval time.Duration
+	// MaxInterval caps the backoff, after jitter is applied.
+	MaxInterval time.Duration
+	// Multiplier is applied to the backoff after each attempt.
+	Multiplier float64
+	// RandomizationFactor adds +/- jitter to each computed backoff, e.g.
+	// 0.5 means the sleep is in [0.5x, 1.5x] of the computed value.
+	RandomizationFactor float64
+	// PerAttemptTimeout bounds a single attempt. Zero means no per-attempt
+	// timeout beyond the request's own context.
+	PerAttemptTimeout time.Duration
+	// ShouldRetry decides whether a completed attempt (res, err) should be
+	// retried. res is nil when err is non-nil. Defaults to
+	// DefaultShouldRetry.
+	ShouldRetry func(res *http.Response, err error) bool
+}
+
+// DefaultRetryConfig returns the middleware defaults: retry connection
+// errors, 502/503/504 and 429, with exponential backoff and jitter.
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAttempts:         3,
+		InitialInterval:     200 * time.Millisecond,
+		MaxInterval:         5 * time.Second,
+		Multiplier:          2,
+		RandomizationFactor: 0.5,
+		ShouldRetry:         DefaultShouldRetry,
+	}
+}
+
+// DefaultShouldRetry retries on connection errors (err != nil, no response)
+// and on 429/502/503/504 responses.
+func DefaultShouldRetry(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	if res == nil {
+		return false
+	}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// RetryMiddleware retries failed requests with exponential backoff and
+// jitter, honoring Retry-After and request cancellation. It must be placed
+// so that it sees the final response/error of the chain below it; register
+// it next to ResponseLimitMiddleware in each datasource's transport options.
+func RetryMiddleware(cfg RetryConfig) sdkhttpclient.Middleware {
+	if cfg.ShouldRetry == nil {
+		cfg.ShouldRetry = DefaultShouldRetry
+	}
+	return sdkhttpclient.NamedMiddlewareFunc(RetryMiddlewareName, func(opts sdkhttpclient.Options, next http.RoundTripper) http.RoundTripper {
+		if cfg.MaxAttempts <= 1 {
+			return next
+		}
+		return sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return roundTripWithRetry(req, next, cfg)
+		})
+	})
+}
+
+func roundTripWithRetry(req *http.Request, next http.RoundTripper, cfg RetryConfig) (*http.Response, error) {
+	ctx, span := tracer.Start(req.Context(), "httpclientprovider.retry")
+	defer span.End()
+
+	var (
+		res   *http.Response
+		err   error
+		delay = cfg.InitialInterval
+	)
+
+	for attempt := 1; attempt <= cfg.MaxAttempts; attempt++ {
+		start := time.Now()
+
+		attemptReq := req
+		if attempt > 1 {
+			attemptReq, err = rewindRequest(req)
+			if err != nil {
+				span.RecordError(err)
+				retriesTotal.WithLabelValues("body-not-rewindable").Inc()
+				return nil, err
+			}
+		}
+
+		attemptCtx := ctx
+		var cancel context.CancelFunc
+		if cfg.PerAttemptTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, cfg.PerAttemptTimeout)
+		}
+		res, err = next.RoundTrip(attemptReq.WithContext(attemptCtx))
+
+		elapsed := time.Since(start)
+		retryable := cfg.ShouldRetry(res, err)
+		reason := classifyAttempt(res, err)
+
+		retryLogger.Debug("HTTP attempt completed", "attempt", attempt, "elapsed", elapsed, "reason", reason, "retryable", retryable)
+		span.SetAttributes(
+			attribute.Int("retry.attempt", attempt),
+			attribute.String("retry.reason", reason),
+			attribute.Bool("retry.retryable", retryable),
+		)
+
+		if !retryable || attempt == cfg.MaxAttempts {
+			if attempt > 1 {
+				outcome := "exhausted"
+				if !retryable {
+					outcome = "succeeded"
+				}
+				retriesTotal.WithLabelValues(outcome).Inc()
+			}
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+			return keepWithCancel(res, cancel), err
+		}
+
+		wait := nextBackoff(delay, cfg)
+		if ra, ok := retryAfter(res); ok && ra > wait {
+			wait = ra
+		}
+		delay = nextDelay(delay, cfg)
+
+		retriesTotal.WithLabelValues("retried").Inc()
+
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			// Retrying would exceed the caller's deadline; return the
+			// last result instead of sleeping past it.
+			return keepWithCancel(res, cancel), err
+		}
+
+		// This attempt is being discarded in favor of a retry: its
+		// context and body are safe to tear down now.
+		if cancel != nil {
+			cancel()
+		}
+		if res != nil && res.Body != nil {
+			_ = res.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return res, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+
+	return res, err
+}
+
+// keepWithCancel arranges for an attempt's per-attempt-timeout context to be
+// canceled once the caller has finished reading and closed res's body,
+// instead of canceling it immediately - which would turn the in-flight body
+// read into a "context canceled" error for the response we're handing back.
+// If res has no body, or there's nothing to cancel, cancel runs right away.
+func keepWithCancel(res *http.Response, cancel context.CancelFunc) *http.Response {
+	if cancel == nil {
+		return res
+	}
+	if res == nil || res.Body == nil {
+		cancel()
+		return res
+	}
+	res.Body = &cancelOnCloseBody{ReadCloser: res.Body, cancel: cancel}
+	return res
+}
+
+// cancelOnCloseBody defers a context cancellation until the wrapped body is
+// closed.
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// rewindRequest clones req with a fresh body obtained from GetBody, so a
+// retried attempt doesn't send an already-drained reader. It errors when
+// the original request had a body but no way to rewind it.
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, errNotRewindable
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	clone := req.Clone(req.Context())
+	clone.Body = body
+	return clone, nil
+}
+
+var errNotRewindable = &retryError{"request body cannot be rewound for retry: GetBody is nil"}
+
+type retryError struct{ msg string }
+
+func (e *retryError) Error() string { return e.msg }
+
+func classifyAttempt(res *http.Response, err error) string {
+	if err != nil {
+		return "error:" + err.Error()
+	}
+	if res == nil {
+		return "no-response"
+	}
+	return strconv.Itoa(res.StatusCode)
+}
+
+func nextBackoff(current time.Duration, cfg RetryConfig) time.Duration {
+	if cfg.RandomizationFactor <= 0 {
+		return current
+	}
+	delta := cfg.RandomizationFactor * float64(current)
+	lo := float64(current) - delta
+	hi := float64(current) + delta
+	jittered := lo + (rand.Float64() * (hi - lo))
+	if cfg.MaxInterval > 0 && time.Duration(jittered) > cfg.MaxInterval {
+		return cfg.MaxInterval
+	}
+	return time.Duration(jittered)
+}
+
+func nextDelay(current time.Duration, cfg RetryConfig) time.Duration {
+	next := time.Duration(float64(current) * cfg.Multiplier)
+	if cfg.MaxInterval > 0 && next > cfg.MaxInterval {
+		return cfg.MaxInterval
+	}
+	return next
+}
+
+// retryAfter parses a Retry-After response header in either delta-seconds
+// or HTTP-date form. ok is false when the header is absent or unparsable.
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	if res == nil {
+		return 0, false
+	}
+	v := res.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(math.Max(0, float64(secs))) * time.Second, true
+	}
+	if when, err := http.ParseTime(v); err == nil {
+		d := time.Until(when)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
@@ -0,0 +1,123 @@
+package httpclientprovider
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func fastRetryConfig() RetryConfig {
+	cfg := DefaultRetryConfig()
+	cfg.InitialInterval = time.Millisecond
+	cfg.MaxInterval = 5 * time.Millisecond
+	return cfg
+}
+
+func TestRetryMiddleware_RetriesOnRetryableStatus(t *testing.T) {
+	var attempts int32
+	next := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		n := atomic.AddInt32(&attempts, 1)
+		if n < 3 {
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: io.NopCloser(strings.NewReader(""))}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok"))}, nil
+	})
+
+	mw := RetryMiddleware(fastRetryConfig())
+	rt := mw.CreateMiddleware(sdkhttpclient.Options{}, next)
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	require.NoError(t, err)
+
+	res, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.EqualValues(t, 3, attempts)
+}
+
+func TestRetryMiddleware_StopsOnNonRetryableStatus(t *testing.T) {
+	var attempts int32
+	next := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&attempts, 1)
+		return &http.Response{StatusCode: http.StatusBadRequest, Body: io.NopCloser(strings.NewReader(""))}, nil
+	})
+
+	mw := RetryMiddleware(fastRetryConfig())
+	rt := mw.CreateMiddleware(sdkhttpclient.Options{}, next)
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	require.NoError(t, err)
+
+	res, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.EqualValues(t, 1, attempts)
+}
+
+func TestRetryMiddleware_GivesUpAfterMaxAttempts(t *testing.T) {
+	var attempts int32
+	next := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&attempts, 1)
+		return nil, errors.New("connection reset")
+	})
+
+	cfg := fastRetryConfig()
+	cfg.MaxAttempts = 3
+	mw := RetryMiddleware(cfg)
+	rt := mw.CreateMiddleware(sdkhttpclient.Options{}, next)
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	require.NoError(t, err)
+
+	_, err = rt.RoundTrip(req)
+	require.Error(t, err)
+	assert.EqualValues(t, 3, attempts)
+}
+
+func TestRetryMiddleware_RefusesToRetryUnrewindableBody(t *testing.T) {
+	var attempts int32
+	next := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&attempts, 1)
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: io.NopCloser(strings.NewReader(""))}, nil
+	})
+
+	mw := RetryMiddleware(fastRetryConfig())
+	rt := mw.CreateMiddleware(sdkhttpclient.Options{}, next)
+
+	req, err := http.NewRequest(http.MethodPost, "http://example.com", strings.NewReader("body"))
+	require.NoError(t, err)
+	req.GetBody = nil // simulate a body that can't be rewound
+
+	_, err = rt.RoundTrip(req)
+	require.Error(t, err)
+	assert.EqualValues(t, 1, attempts)
+}
+
+func TestRetryAfter(t *testing.T) {
+	res := &http.Response{Header: http.Header{"Retry-After": []string{"2"}}}
+	d, ok := retryAfter(res)
+	require.True(t, ok)
+	assert.Equal(t, 2*time.Second, d)
+
+	future := time.Now().Add(3 * time.Second).UTC().Format(http.TimeFormat)
+	res = &http.Response{Header: http.Header{"Retry-After": []string{future}}}
+	d, ok = retryAfter(res)
+	require.True(t, ok)
+	assert.InDelta(t, 3*time.Second, d, float64(time.Second))
+
+	res = &http.Response{Header: http.Header{}}
+	_, ok = retryAfter(res)
+	assert.False(t, ok)
+}
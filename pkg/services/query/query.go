@@ -0,0 +1,37 @@
+package query
+
+import (
+	"context"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// Executor runs a single resolved query against its datasource's plugin
+// client.
+type Executor func(ctx context.Context, pq parsedQuery) backend.DataResponse
+
+// ServiceImpl dispatches a parsed request's queries to their datasources,
+// fanning them out through executeConcurrently so the per-datasource
+// circuit breaker and AIMD concurrency limiter gate real dispatch instead
+// of a fixed worker count.
+type ServiceImpl struct {
+	exec Executor
+}
+
+func ProvideService(exec Executor) *ServiceImpl {
+	return &ServiceImpl{exec: exec}
+}
+
+// QueryData validates pr and executes its queries, returning one
+// backend.DataResponse per RefID.
+func (s *ServiceImpl) QueryData(ctx context.Context, pr parsedRequest) (*backend.QueryDataResponse, error) {
+	if err := pr.validateRequest(ctx); err != nil {
+		return nil, err
+	}
+
+	result := backend.NewQueryDataResponse()
+	for refID, res := range pr.executeConcurrently(ctx, s.exec) {
+		result.Responses[refID] = res
+	}
+	return result, nil
+}
@@ -0,0 +1,116 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+
+	"github.com/xquare-dashboard/pkg/infra/circuitbreaker"
+)
+
+// resilience is circuitbreaker.Shared, the registry also consulted by
+// pkg/tsdb/loki, so a datasource dispatched through both paths is gated by
+// one breaker/limiter pair rather than two independent ones.
+var resilience = circuitbreaker.Shared
+
+// breakerKey identifies a datasource instance for circuit-breaker and
+// concurrency-limiter purposes.
+func (pq parsedQuery) breakerKey() string {
+	return fmt.Sprintf("%s/%s", pq.datasource.Type, pq.datasource.UID)
+}
+
+// executeConcurrently runs exec for every flattened query in pr, grouped by
+// datasource and gated by a per-datasource circuit breaker and an AIMD
+// concurrency limiter in place of a fixed worker count. Queries whose
+// datasource's breaker is open fail-fast with
+// circuitbreaker.ErrUpstreamUnavailable instead of being dispatched. The
+// result is keyed by RefID, which validateRequest guarantees is unique
+// within pr.
+func (pr parsedRequest) executeConcurrently(ctx context.Context, exec func(context.Context, parsedQuery) backend.DataResponse) map[string]backend.DataResponse {
+	results := make(map[string]backend.DataResponse, len(pr.getFlattenedQueries()))
+	var resultsMu sync.Mutex
+
+	var wg sync.WaitGroup
+	for _, pqs := range pr.parsedQueries {
+		if len(pqs) == 0 {
+			continue
+		}
+		pqs := pqs
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			executeGroup(ctx, pqs, exec, results, &resultsMu)
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// executeGroup runs exec for one datasource's queries, gated by that
+// datasource's breaker and limiter, and writes each result into results
+// under resultsMu.
+func executeGroup(
+	ctx context.Context,
+	pqs []parsedQuery,
+	exec func(context.Context, parsedQuery) backend.DataResponse,
+	results map[string]backend.DataResponse,
+	resultsMu *sync.Mutex,
+) {
+	key := pqs[0].breakerKey()
+	limiter := resilience.Limiter(key)
+	breaker := resilience.Breaker(key)
+
+	sem := make(chan struct{}, limiter.Permits())
+	var wg sync.WaitGroup
+
+	var failedMu sync.Mutex
+	batchFailed := false
+
+	for _, pq := range pqs {
+		pq := pq
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+
+			var res backend.DataResponse
+			var failed bool
+			if err := breaker.Allow(); err != nil {
+				res, failed = backend.DataResponse{Error: err}, true
+			} else {
+				start := time.Now()
+				res = exec(ctx, pq)
+				failed = isUpstreamFailure(res)
+				breaker.RecordResult(failed, time.Since(start))
+			}
+
+			if failed {
+				failedMu.Lock()
+				batchFailed = true
+				failedMu.Unlock()
+			}
+
+			resultsMu.Lock()
+			results[pq.query.RefID] = res
+			resultsMu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if batchFailed {
+		limiter.OnFailure()
+	} else {
+		limiter.OnSuccess()
+	}
+}
+
+// isUpstreamFailure reports whether res should count against the
+// datasource's circuit breaker and concurrency limiter, i.e. a genuine
+// upstream problem rather than e.g. an invalid query.
+func isUpstreamFailure(res backend.DataResponse) bool {
+	return res.Error != nil && res.ErrorSource != backend.ErrorSourcePlugin
+}
@@ -0,0 +1,70 @@
+package query
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xquare-dashboard/pkg/services/datasources"
+)
+
+func testParsedRequest(n int) parsedRequest {
+	ds := &datasources.DataSource{Type: "loki", UID: "ds-1"}
+	pqs := make([]parsedQuery, n)
+	for i := range pqs {
+		pqs[i] = parsedQuery{
+			query:      backend.DataQuery{RefID: string(rune('A' + i))},
+			datasource: ds,
+		}
+	}
+	return parsedRequest{
+		parsedQueries: map[datasources.DataSourceType][]parsedQuery{
+			"loki": pqs,
+		},
+	}
+}
+
+func TestExecuteConcurrently_ReturnsOneResultPerRefID(t *testing.T) {
+	pr := testParsedRequest(8)
+
+	var calls int32
+	results := pr.executeConcurrently(context.Background(), func(ctx context.Context, pq parsedQuery) backend.DataResponse {
+		atomic.AddInt32(&calls, 1)
+		return backend.DataResponse{}
+	})
+
+	assert.EqualValues(t, 8, calls)
+	require.Len(t, results, 8)
+	for _, pq := range pr.getFlattenedQueries() {
+		_, ok := results[pq.query.RefID]
+		assert.True(t, ok, "missing result for %s", pq.query.RefID)
+	}
+}
+
+func TestExecuteConcurrently_FailuresDontPanicOrDropResults(t *testing.T) {
+	pr := testParsedRequest(20)
+
+	results := pr.executeConcurrently(context.Background(), func(ctx context.Context, pq parsedQuery) backend.DataResponse {
+		return backend.DataResponse{Error: assert.AnError}
+	})
+
+	require.Len(t, results, 20)
+	for _, res := range results {
+		assert.Error(t, res.Error)
+	}
+}
+
+func TestServiceImpl_QueryData(t *testing.T) {
+	pr := testParsedRequest(3)
+	svc := ProvideService(func(ctx context.Context, pq parsedQuery) backend.DataResponse {
+		return backend.DataResponse{}
+	})
+
+	resp, err := svc.QueryData(context.Background(), pr)
+	require.NoError(t, err)
+	assert.Len(t, resp.Responses, 3)
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/grafana/grafana-plugin-sdk-go/data"
 
 	"github.com/xquare-dashboard/pkg/infra/httpclient"
+	"github.com/xquare-dashboard/pkg/infra/httpclient/httpclientprovider"
 	"github.com/xquare-dashboard/pkg/infra/log"
 	"github.com/xquare-dashboard/pkg/tsdb/loki/kinds/dataquery"
 )
@@ -59,12 +60,30 @@ type datasourceInfo struct {
 	// open streams
 	streams   map[string]data.FrameJSONCache
 	streamsMu sync.RWMutex
+
+	// DefaultShardCount is the shard-mapper fan-out used for metric
+	// queries that don't set their own `shards`, read from the
+	// datasource's jsonData. 0 or 1 disables sharding by default.
+	DefaultShardCount int
+	// SupportsStreamShards reports whether the target Loki understands
+	// the __stream_shard__ matcher; when false the shard mapper falls
+	// back to splitting the query time range instead.
+	SupportsStreamShards bool
 }
 
 type QueryJSONModel struct {
 	dataquery.LokiDataQuery
 	Direction           *string `json:"direction,omitempty"`
 	SupportingQueryType *string `json:"supportingQueryType"`
+	// Shards overrides the datasource's default shard count for this
+	// query. 1 disables the shard mapper for the query; 0 or unset uses
+	// the datasource default.
+	Shards *int `json:"shards,omitempty"`
+}
+
+type jsonData struct {
+	DefaultShardCount    int  `json:"shardCount"`
+	SupportsStreamShards bool `json:"streamShardingSupported"`
 }
 
 type ResponseOpts struct {
@@ -84,16 +103,29 @@ func newInstanceSettings(httpClientProvider httpclient.Provider) datasource.Inst
 		if err != nil {
 			return nil, err
 		}
+		opts.Middlewares = append(opts.Middlewares,
+			httpclientprovider.RetryMiddleware(httpclientprovider.DefaultRetryConfig()),
+			httpclientprovider.CacheMiddleware(httpclientprovider.DefaultCacheConfig(), nil),
+		)
 
 		client, err := httpClientProvider.New(opts)
 		if err != nil {
 			return nil, err
 		}
 
+		var jd jsonData
+		if len(settings.JSONData) > 0 {
+			// Best-effort: an invalid/missing jsonData just means
+			// sharding defaults to disabled, it's not fatal.
+			_ = json.Unmarshal(settings.JSONData, &jd)
+		}
+
 		model := &datasourceInfo{
-			HTTPClient: client,
-			URL:        settings.URL,
-			streams:    make(map[string]data.FrameJSONCache),
+			HTTPClient:           client,
+			URL:                  settings.URL,
+			streams:              make(map[string]data.FrameJSONCache),
+			DefaultShardCount:    jd.DefaultShardCount,
+			SupportsStreamShards: jd.SupportsStreamShards,
 		}
 		return model, nil
 	}
@@ -167,6 +199,19 @@ func queryData(
 ) (*backend.QueryDataResponse, error) {
 	result := backend.NewQueryDataResponse()
 
+	uid := ""
+	if req.PluginContext.DataSourceInstanceSettings != nil {
+		uid = req.PluginContext.DataSourceInstanceSettings.UID
+	}
+	key := breakerKey(uid)
+	breaker := resilience.Breaker(key)
+	limiter := resilience.Limiter(key)
+
+	if err := breaker.Allow(); err != nil {
+		plog.Warn("Loki circuit breaker open, failing fast", "error", err, "datasource", uid)
+		return result, err
+	}
+
 	api := newLokiAPI(dsInfo.HTTPClient, dsInfo.URL, plog, requestStructuredMetadata)
 
 	start := time.Now()
@@ -178,29 +223,62 @@ func queryData(
 
 	plog.Info("Prepared request to Loki", "duration", time.Since(start), "queriesLength", len(queries), "stage", stagePrepareRequest, "runInParallel", runInParallel)
 
+	shardMapper := NewShardMapper(dsInfo.SupportsStreamShards)
+
+	batchStart := time.Now()
+	batchFailed := false
+
 	// We are testing running of queries in parallel behind feature flag
 	if runInParallel {
 		resultLock := sync.Mutex{}
-		err = concurrency.ForEachJob(ctx, len(queries), 10, func(ctx context.Context, idx int) error {
+		err = concurrency.ForEachJob(ctx, len(queries), limiter.Permits(), func(ctx context.Context, idx int) error {
 			query := queries[idx]
-			queryRes := executeQuery(ctx, query, api, responseOpts, plog)
+			queryRes := executeQuery(ctx, query, api, shardMapper, dsInfo.DefaultShardCount, limiter.Permits(), responseOpts, plog)
 
 			resultLock.Lock()
 			defer resultLock.Unlock()
+			if isUpstreamFailure(queryRes) {
+				batchFailed = true
+			}
 			result.Responses[query.RefID] = queryRes
 			return nil // errors are saved per-query,always return nil
 		})
 	} else {
 		for _, query := range queries {
-			queryRes := executeQuery(ctx, query, api, responseOpts, plog)
+			queryRes := executeQuery(ctx, query, api, shardMapper, dsInfo.DefaultShardCount, limiter.Permits(), responseOpts, plog)
+			if isUpstreamFailure(queryRes) {
+				batchFailed = true
+			}
 			result.Responses[query.RefID] = queryRes
 		}
 	}
-	plog.Debug("Executed queries", "duration", time.Since(start), "queriesLength", len(queries), "runInParallel", runInParallel)
+
+	breaker.RecordResult(batchFailed, time.Since(batchStart))
+	if batchFailed {
+		limiter.OnFailure()
+	} else {
+		limiter.OnSuccess()
+	}
+
+	plog.Debug("Executed queries", "duration", time.Since(start), "queriesLength", len(queries), "runInParallel", runInParallel, "concurrency", limiter.Permits())
 	return result, err
 }
 
-func executeQuery(ctx context.Context, query *lokiQuery, api *LokiAPI, responseOpts ResponseOpts, plog log.Logger) backend.DataResponse {
+// isUpstreamFailure reports whether queryRes should count against the
+// datasource's circuit breaker and concurrency limiter, i.e. a genuine
+// upstream problem rather than e.g. an invalid query.
+func isUpstreamFailure(queryRes backend.DataResponse) bool {
+	return queryRes.Error != nil && queryRes.ErrorSource != backend.ErrorSourcePlugin
+}
+
+func executeQuery(ctx context.Context, query *lokiQuery, api *LokiAPI, shardMapper *ShardMapper, defaultShards, permits int, responseOpts ResponseOpts, plog log.Logger) backend.DataResponse {
+	shards := query.Shards
+	if shards == 0 {
+		shards = defaultShards
+	}
+	if plan, ok := shardMapper.Map(query, shards); ok {
+		return executeShardedQuery(ctx, query, plan, permits, api, responseOpts, plog)
+	}
 
 	frames, err := runQuery(ctx, api, query, responseOpts, plog)
 	queryRes := backend.DataResponse{}
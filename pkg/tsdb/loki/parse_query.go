@@ -0,0 +1,45 @@
+package loki
+
+import (
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// parseQuery builds the internal lokiQuery form ShardMapper/runQuery operate
+// on from each raw query in req.
+func parseQuery(req *backend.QueryDataRequest) ([]*lokiQuery, error) {
+	qs := make([]*lokiQuery, 0, len(req.Queries))
+
+	for _, query := range req.Queries {
+		model, err := parseQueryModel(query.JSON)
+		if err != nil {
+			return nil, err
+		}
+
+		queryType := QueryTypeRange
+		if QueryType(model.LokiDataQuery.QueryType) == QueryTypeInstant {
+			queryType = QueryTypeInstant
+		}
+
+		direction := directionBackward
+		if model.Direction != nil && *model.Direction == directionForward {
+			direction = directionForward
+		}
+
+		shards := 0
+		if model.Shards != nil {
+			shards = *model.Shards
+		}
+
+		qs = append(qs, &lokiQuery{
+			Expr:      model.LokiDataQuery.Expr,
+			QueryType: queryType,
+			Direction: direction,
+			RefID:     query.RefID,
+			Start:     query.TimeRange.From,
+			End:       query.TimeRange.To,
+			Shards:    shards,
+		})
+	}
+
+	return qs, nil
+}
@@ -0,0 +1,15 @@
+package loki
+
+import (
+	"github.com/xquare-dashboard/pkg/infra/circuitbreaker"
+)
+
+// resilience is circuitbreaker.Shared, the same registry pkg/services/query
+// consults, keyed by datasource UID the same way it keys its own breakers
+// (datasource type + UID; the type is always "loki" here) so a datasource
+// reached through both dispatch paths shares one breaker/limiter pair.
+var resilience = circuitbreaker.Shared
+
+func breakerKey(uid string) string {
+	return "loki/" + uid
+}
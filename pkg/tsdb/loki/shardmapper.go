@@ -0,0 +1,544 @@
+package loki
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/dskit/concurrency"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
+	"github.com/xquare-dashboard/pkg/infra/log"
+)
+
+// reducerKind identifies how the per-shard results of a sharded metric query
+// must be recombined to reconstruct the answer to the original query.
+type reducerKind int
+
+const (
+	reducerSum reducerKind = iota
+	reducerMin
+	reducerMax
+)
+
+// nonShardableAggregations mirrors logql's shardmapper: these aggregations
+// cannot be decomposed into an associative reducer over stream shards
+// without first being rewritten in terms of sum/count, which we don't
+// attempt here. topk/bottomk need the full set of per-shard candidates
+// re-ranked, not a per-row merge, so they're treated the same way.
+var nonShardableAggregations = map[string]bool{
+	"avg":     true,
+	"stddev":  true,
+	"stdvar":  true,
+	"absent":  true,
+	"bottomk": true,
+	"topk":    true,
+}
+
+// shardableAggregations maps the vector aggregations we know how to
+// recombine to the reducer used to merge shard results.
+var shardableAggregations = map[string]reducerKind{
+	"sum":   reducerSum,
+	"min":   reducerMin,
+	"max":   reducerMax,
+	"count": reducerSum,
+}
+
+// nonShardableAggregationRes and shardableAggregationRes precompile the
+// per-aggregation `\bagg\s*\(` regexes once at package init, since Map and
+// detectReducer run on every dispatched query.
+var (
+	nonShardableAggregationRes = compileAggRes(nonShardableAggregations)
+	shardableAggregationRes    = compileAggRes(shardableAggregations)
+)
+
+// compileAggRes precompiles a `\bagg\s*\(` regexp for each aggregation name
+// keying aggs, regardless of aggs' value type.
+func compileAggRes[T any](aggs map[string]T) map[string]*regexp.Regexp {
+	res := make(map[string]*regexp.Regexp, len(aggs))
+	for agg := range aggs {
+		res[agg] = regexp.MustCompile(`\b` + agg + `\s*\(`)
+	}
+	return res
+}
+
+// rangeVectorFuncs matches the log-range aggregations that can be computed
+// per shard and merged. When one is wrapped in an outer aggregation (e.g.
+// sum(rate(...))), the reducer comes from that outer aggregation.
+var rangeVectorFuncs = regexp.MustCompile(`\b(rate|count_over_time|bytes_rate|bytes_over_time|sum_over_time)\s*\(`)
+
+var quantileOverTimeRe = regexp.MustCompile(`\bquantile_over_time\s*\(`)
+
+var streamShardLabel = "__stream_shard__"
+
+// shardPlan describes how the shard mapper decided to split a query.
+type shardPlan struct {
+	shardCount int
+	reducer    reducerKind
+	// useStreamShard is true when the datasource supports Loki's native
+	// stream sharding (injecting the __stream_shard__ matcher). When
+	// false, the mapper falls back to splitting the query's [Start,End]
+	// range into shardCount equal, step-aligned intervals instead.
+	useStreamShard bool
+}
+
+// ShardMapper decides whether a LogQL query can be safely executed as
+// independent sub-queries and, if so, produces the sub-queries plus the
+// reducer needed to merge their results back into one answer. It is
+// modeled on Loki's own logql shardmapper, but operates on the already
+// extracted query fields rather than a parsed AST since this package does
+// not carry a LogQL parser of its own.
+type ShardMapper struct {
+	// supportsStreamShards reports whether the target Loki instance
+	// understands the __stream_shard__ matcher. When false, Map falls
+	// back to splitting the query time range instead.
+	supportsStreamShards bool
+}
+
+func NewShardMapper(supportsStreamShards bool) *ShardMapper {
+	return &ShardMapper{supportsStreamShards: supportsStreamShards}
+}
+
+// Map returns the shard plan for query, or ok=false when query should run
+// unsharded (not a metric query, contains a non-associative aggregation, or
+// shards <= 1).
+func (m *ShardMapper) Map(query *lokiQuery, shards int) (shardPlan, bool) {
+	if shards <= 1 {
+		return shardPlan{}, false
+	}
+	if query.QueryType != QueryTypeRange && query.QueryType != QueryTypeInstant {
+		return shardPlan{}, false
+	}
+
+	expr := query.Expr
+	for _, re := range nonShardableAggregationRes {
+		if re.MatchString(expr) {
+			return shardPlan{}, false
+		}
+	}
+
+	reducer, ok := detectReducer(expr)
+	if !ok {
+		return shardPlan{}, false
+	}
+
+	return shardPlan{
+		shardCount:     shards,
+		reducer:        reducer,
+		useStreamShard: m.supportsStreamShards,
+	}, true
+}
+
+// detectReducer inspects the textual LogQL expression for its outermost
+// aggregation and returns the reducer needed to merge shard-scoped results.
+// It does not attempt to shard expressions that contain no recognizable
+// aggregation, since a bare log-line or unaggregated range query is either
+// not a metric query or would change meaning if merged naively.
+func detectReducer(expr string) (reducerKind, bool) {
+	// quantile_over_time has no associative merge without a real quantile
+	// sketch (t-digest/DDSketch), which this package doesn't carry, so
+	// refuse to shard it rather than silently return wrong quantiles.
+	if quantileOverTimeRe.MatchString(expr) {
+		return reducerSum, false
+	}
+
+	// Find every shardable aggregation's match position and take the
+	// leftmost one, since for nested calls like max(sum(rate(...))) the
+	// outermost aggregation's name appears first in the text. Iterating
+	// shardableAggregations directly would pick whichever entry the map
+	// happened to yield first, which is nondeterministic.
+	best := -1
+	var bestKind reducerKind
+	for agg, kind := range shardableAggregations {
+		loc := shardableAggregationRes[agg].FindStringIndex(expr)
+		if loc == nil {
+			continue
+		}
+		if best == -1 || loc[0] < best {
+			best = loc[0]
+			bestKind = kind
+		}
+	}
+	if best != -1 {
+		return bestKind, true
+	}
+
+	if rangeVectorFuncs.MatchString(expr) {
+		// An un-aggregated range vector function (e.g. a bare
+		// `rate(...)` with no outer sum/count) is still associative
+		// under concatenation-by-timestamp, so allow sharding with a
+		// sum reducer; mergeShardedFrames treats range-vector results
+		// as a per-series concat rather than a true sum.
+		return reducerSum, true
+	}
+	return reducerSum, false
+}
+
+// shardQueries builds shards sub-queries from query according to plan. Each
+// sub-query is identical except for either an injected __stream_shard__
+// matcher or a shard-scoped, step-aligned [Start,End] window.
+func shardQueries(query *lokiQuery, plan shardPlan) []*lokiQuery {
+	out := make([]*lokiQuery, 0, plan.shardCount)
+	if plan.useStreamShard {
+		for i := 0; i < plan.shardCount; i++ {
+			q := *query
+			q.Expr = injectStreamShardMatcher(query.Expr, i)
+			out = append(out, &q)
+		}
+		return out
+	}
+
+	total := query.End.Sub(query.Start)
+	step := total / time.Duration(plan.shardCount)
+	if step <= 0 {
+		step = total
+	}
+	start := query.Start
+	for i := 0; i < plan.shardCount; i++ {
+		end := start.Add(step)
+		if i == plan.shardCount-1 || end.After(query.End) {
+			end = query.End
+		}
+		q := *query
+		q.Start = start
+		q.End = end
+		out = append(out, &q)
+		start = end
+	}
+	return out
+}
+
+var selectorRe = regexp.MustCompile(`\{[^}]*\}`)
+
+// injectStreamShardMatcher adds a __stream_shard__="<idx>" matcher to the
+// first label selector found in expr, matching how Loki's query-frontend
+// rewrites shard-mapped sub-queries.
+func injectStreamShardMatcher(expr string, shard int) string {
+	matcher := fmt.Sprintf(`%s="%d"`, streamShardLabel, shard)
+	replaced := false
+	return selectorRe.ReplaceAllStringFunc(expr, func(sel string) string {
+		if replaced {
+			return sel
+		}
+		replaced = true
+		inner := sel[1 : len(sel)-1]
+		if inner == "" {
+			return "{" + matcher + "}"
+		}
+		return "{" + matcher + "," + inner + "}"
+	})
+}
+
+// executeShardedQuery runs the shards of a sharded query concurrently
+// through api, gated by the same AIMD concurrency limiter permits used by
+// the unsharded parallel query loop, and merges the results according to
+// plan.
+func executeShardedQuery(ctx context.Context, query *lokiQuery, plan shardPlan, permits int, api *LokiAPI, responseOpts ResponseOpts, plog log.Logger) backend.DataResponse {
+	shards := shardQueries(query, plan)
+	frameSets := make([]data.Frames, len(shards))
+
+	var resultLock sync.Mutex
+	err := concurrency.ForEachJob(ctx, len(shards), permits, func(ctx context.Context, idx int) error {
+		frames, err := runQuery(ctx, api, shards[idx], responseOpts, plog)
+		if err != nil {
+			return err
+		}
+		resultLock.Lock()
+		defer resultLock.Unlock()
+		frameSets[idx] = frames
+		return nil
+	})
+	if err != nil {
+		return backend.DataResponse{Error: err}
+	}
+
+	merged, err := mergeShardedFrames(plan, query, frameSets)
+	if err != nil {
+		return backend.DataResponse{Error: err}
+	}
+	return backend.DataResponse{Frames: merged}
+}
+
+// mergeShardedFrames recombines the per-shard frame sets of a sharded query
+// into a single data.Frames for the RefID. Range vectors are merged by
+// timestamp (reducing same-timestamp points for stream-sharded plans,
+// concatenating disjoint time-split windows), instant vectors are collapsed
+// with the associative reducer, and log-line results are handled by
+// mergeLogFrames, which orders whole frames rather than individual lines.
+func mergeShardedFrames(plan shardPlan, query *lokiQuery, frameSets []data.Frames) (data.Frames, error) {
+	switch query.QueryType {
+	case QueryTypeInstant:
+		return mergeInstantFrames(plan.reducer, frameSets)
+	case QueryTypeRange:
+		return mergeRangeFrames(query, plan, frameSets)
+	default:
+		return nil, fmt.Errorf("cannot merge sharded results for query type %q", query.QueryType)
+	}
+}
+
+func mergeInstantFrames(reducer reducerKind, frameSets []data.Frames) (data.Frames, error) {
+	byLabels := map[string]*data.Frame{}
+	order := make([]string, 0)
+
+	for _, frames := range frameSets {
+		for _, f := range frames {
+			key := f.Name
+			if existing, ok := byLabels[key]; ok {
+				if err := reduceInto(existing, f, reducer); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			byLabels[key] = f
+			order = append(order, key)
+		}
+	}
+
+	out := make(data.Frames, 0, len(order))
+	for _, key := range order {
+		out = append(out, byLabels[key])
+	}
+	return out, nil
+}
+
+// reduceInto folds src's value column into dst in place using reducer.
+// Both frames are assumed to share the same single-row shape produced by an
+// instant vector query.
+func reduceInto(dst, src *data.Frame, reducer reducerKind) error {
+	if len(dst.Fields) != len(src.Fields) {
+		return fmt.Errorf("shard result shape mismatch for %q", dst.Name)
+	}
+	for i, field := range dst.Fields {
+		if field.Type() != data.FieldTypeFloat64 && field.Type() != data.FieldTypeNullableFloat64 {
+			continue
+		}
+		for row := 0; row < field.Len() && row < src.Fields[i].Len(); row++ {
+			a, aOk := field.FloatAt(row)
+			b, bOk := src.Fields[i].FloatAt(row)
+			if !bOk {
+				continue
+			}
+			if !aOk {
+				field.Set(row, b)
+				continue
+			}
+			field.Set(row, reduceValue(reducer, a, b))
+		}
+	}
+	return nil
+}
+
+// reduceValue combines two values from the same row/column of two shards'
+// results according to reducer.
+func reduceValue(reducer reducerKind, a, b float64) float64 {
+	switch reducer {
+	case reducerMin:
+		if b < a {
+			return b
+		}
+		return a
+	case reducerMax:
+		if b > a {
+			return b
+		}
+		return a
+	default: // reducerSum
+		return a + b
+	}
+}
+
+func mergeRangeFrames(query *lokiQuery, plan shardPlan, frameSets []data.Frames) (data.Frames, error) {
+	if query.isLogQuery() {
+		return mergeLogFrames(query, frameSets)
+	}
+
+	byName := map[string]*data.Frame{}
+	order := make([]string, 0)
+	for _, frames := range frameSets {
+		for _, f := range frames {
+			existing, ok := byName[f.Name]
+			if !ok {
+				byName[f.Name] = f
+				order = append(order, f.Name)
+				continue
+			}
+
+			var merged *data.Frame
+			var err error
+			if plan.useStreamShard {
+				// Stream-sharded sub-queries all cover the same time
+				// range, so the same series can come back with the same
+				// timestamp from more than one shard; reduce those points
+				// with plan.reducer instead of duplicating them.
+				merged, err = reduceRangeByTimestamp(existing, f, plan.reducer)
+			} else {
+				// Time-split sub-queries cover disjoint windows, so their
+				// rows never share a timestamp and can simply be
+				// concatenated.
+				merged, err = concatByTimestamp(existing, f)
+			}
+			if err != nil {
+				return nil, err
+			}
+			byName[f.Name] = merged
+		}
+	}
+
+	out := make(data.Frames, 0, len(order))
+	for _, name := range order {
+		out = append(out, byName[name])
+	}
+	return out, nil
+}
+
+// reduceRangeByTimestamp merges b's rows into a: rows whose timestamp a
+// already has are reduced column-wise with reducer in place, and rows at
+// timestamps a doesn't have are appended, preserving sort order by time.
+func reduceRangeByTimestamp(a, b *data.Frame, reducer reducerKind) (*data.Frame, error) {
+	timeIdx := -1
+	for i, f := range a.Fields {
+		if f.Type() == data.FieldTypeTime {
+			timeIdx = i
+			break
+		}
+	}
+	if timeIdx < 0 {
+		return nil, fmt.Errorf("frame %q has no time field to merge shards on", a.Name)
+	}
+
+	rowByTime := make(map[time.Time]int, a.Fields[timeIdx].Len())
+	for row := 0; row < a.Fields[timeIdx].Len(); row++ {
+		t, _ := a.Fields[timeIdx].At(row).(time.Time)
+		rowByTime[t] = row
+	}
+
+	var toAppend []int
+	for row := 0; row < b.Fields[timeIdx].Len(); row++ {
+		t, _ := b.Fields[timeIdx].At(row).(time.Time)
+		existingRow, ok := rowByTime[t]
+		if !ok {
+			toAppend = append(toAppend, row)
+			continue
+		}
+		for i, field := range a.Fields {
+			if i == timeIdx || (field.Type() != data.FieldTypeFloat64 && field.Type() != data.FieldTypeNullableFloat64) {
+				continue
+			}
+			av, aOk := field.FloatAt(existingRow)
+			bv, bOk := b.Fields[i].FloatAt(row)
+			if !bOk {
+				continue
+			}
+			if !aOk {
+				field.Set(existingRow, bv)
+				continue
+			}
+			field.Set(existingRow, reduceValue(reducer, av, bv))
+		}
+	}
+
+	if len(toAppend) == 0 {
+		return a, nil
+	}
+
+	base := a.Fields[timeIdx].Len()
+	a.Extend(len(toAppend))
+	for offset, row := range toAppend {
+		for i := range a.Fields {
+			a.Set(i, base+offset, b.Fields[i].At(row))
+		}
+	}
+
+	sort.Sort(byTimeField{a, timeIdx})
+	return a, nil
+}
+
+// concatByTimestamp appends b's rows to a and sorts the combined frame by
+// its time field, which every shard of a range-vector query shares.
+func concatByTimestamp(a, b *data.Frame) (*data.Frame, error) {
+	timeIdx := -1
+	for i, f := range a.Fields {
+		if f.Type() == data.FieldTypeTime {
+			timeIdx = i
+			break
+		}
+	}
+	if timeIdx < 0 {
+		return nil, fmt.Errorf("frame %q has no time field to merge shards on", a.Name)
+	}
+
+	a.Extend(b.Fields[timeIdx].Len())
+	for i := range a.Fields {
+		for row := 0; row < b.Fields[i].Len(); row++ {
+			a.Set(i, a.Fields[i].Len()-b.Fields[i].Len()+row, b.Fields[i].At(row))
+		}
+	}
+
+	sort.Sort(byTimeField{a, timeIdx})
+	return a, nil
+}
+
+type byTimeField struct {
+	frame *data.Frame
+	idx   int
+}
+
+func (b byTimeField) Len() int { return b.frame.Fields[b.idx].Len() }
+func (b byTimeField) Less(i, j int) bool {
+	ti, _ := b.frame.Fields[b.idx].At(i).(time.Time)
+	tj, _ := b.frame.Fields[b.idx].At(j).(time.Time)
+	return ti.Before(tj)
+}
+func (b byTimeField) Swap(i, j int) {
+	for _, f := range b.frame.Fields {
+		vi, vj := f.At(i), f.At(j)
+		f.Set(i, vj)
+		f.Set(j, vi)
+	}
+}
+
+// mergeLogFrames concatenates the shards' log-line frames and orders the
+// frames by the timestamp of each frame's first row, newest-first for
+// query.Direction "backward" and oldest-first otherwise, with the string form
+// of the first field's labels as a stable tiebreaker. Rows are not
+// interleaved across frames, and the rows within a frame keep their order.
+func mergeLogFrames(query *lokiQuery, frameSets []data.Frames) (data.Frames, error) {
+	all := make(data.Frames, 0)
+	for _, frames := range frameSets {
+		all = append(all, frames...)
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		ti, tj := frameTime(all[i]), frameTime(all[j])
+		if !ti.Equal(tj) {
+			if query.Direction == directionBackward {
+				return ti.After(tj)
+			}
+			return ti.Before(tj)
+		}
+		return labelsHash(all[i]) < labelsHash(all[j])
+	})
+
+	return all, nil
+}
+
+func frameTime(f *data.Frame) time.Time {
+	for _, field := range f.Fields {
+		if field.Type() == data.FieldTypeTime && field.Len() > 0 {
+			t, _ := field.At(0).(time.Time)
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func labelsHash(f *data.Frame) string {
+	if f.Fields == nil || len(f.Fields) == 0 {
+		return ""
+	}
+	return f.Fields[0].Labels.String()
+}
@@ -0,0 +1,200 @@
+package loki
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardMapper_Map(t *testing.T) {
+	start := time.Unix(0, 0)
+	end := start.Add(time.Hour)
+
+	for _, tc := range []struct {
+		name       string
+		expr       string
+		queryType  QueryType
+		shards     int
+		expectOk   bool
+		expectKind reducerKind
+	}{
+		{
+			name:       "sum of rate is shardable",
+			expr:       `sum(rate({job="app"}[5m]))`,
+			queryType:  QueryTypeRange,
+			shards:     4,
+			expectOk:   true,
+			expectKind: reducerSum,
+		},
+		{
+			name:       "count_over_time is shardable",
+			expr:       `count_over_time({job="app"}[5m])`,
+			queryType:  QueryTypeRange,
+			shards:     4,
+			expectOk:   true,
+			expectKind: reducerSum,
+		},
+		{
+			name:       "max of count_over_time is shardable with max reducer",
+			expr:       `max(count_over_time({job="app"}[5m]))`,
+			queryType:  QueryTypeRange,
+			shards:     4,
+			expectOk:   true,
+			expectKind: reducerMax,
+		},
+		{
+			name:      "quantile_over_time is not shardable without a quantile sketch",
+			expr:      `quantile_over_time(0.95, {job="app"} | unwrap latency [5m])`,
+			queryType: QueryTypeRange,
+			shards:    4,
+			expectOk:  false,
+		},
+		{
+			name:      "topk is not shardable",
+			expr:      `topk(5, sum(rate({job="app"}[5m])))`,
+			queryType: QueryTypeRange,
+			shards:    4,
+			expectOk:  false,
+		},
+		{
+			name:      "avg is not shardable",
+			expr:      `avg(rate({job="app"}[5m]))`,
+			queryType: QueryTypeRange,
+			shards:    4,
+			expectOk:  false,
+		},
+		{
+			name:      "stddev is not shardable",
+			expr:      `stddev(rate({job="app"}[5m]))`,
+			queryType: QueryTypeRange,
+			shards:    4,
+			expectOk:  false,
+		},
+		{
+			name:      "absent is not shardable",
+			expr:      `absent({job="app"}[5m])`,
+			queryType: QueryTypeRange,
+			shards:    4,
+			expectOk:  false,
+		},
+		{
+			name:      "bare log-line selector is not shardable",
+			expr:      `{job="app"} |= "error"`,
+			queryType: QueryTypeRange,
+			shards:    4,
+			expectOk:  false,
+		},
+		{
+			name:      "shards of 1 disables sharding",
+			expr:      `sum(rate({job="app"}[5m]))`,
+			queryType: QueryTypeRange,
+			shards:    1,
+			expectOk:  false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewShardMapper(true)
+			q := &lokiQuery{
+				Expr:      tc.expr,
+				QueryType: tc.queryType,
+				Start:     start,
+				End:       end,
+			}
+			plan, ok := m.Map(q, tc.shards)
+			assert.Equal(t, tc.expectOk, ok)
+			if tc.expectOk {
+				assert.Equal(t, tc.expectKind, plan.reducer)
+				assert.Equal(t, tc.shards, plan.shardCount)
+			}
+		})
+	}
+}
+
+func TestShardQueries_StreamShard(t *testing.T) {
+	start := time.Unix(0, 0)
+	end := start.Add(time.Hour)
+	q := &lokiQuery{
+		Expr:      `sum(rate({job="app"}[5m]))`,
+		QueryType: QueryTypeRange,
+		Start:     start,
+		End:       end,
+	}
+
+	m := NewShardMapper(true)
+	plan, ok := m.Map(q, 3)
+	require.True(t, ok)
+
+	shards := shardQueries(q, plan)
+	require.Len(t, shards, 3)
+	for i, s := range shards {
+		assert.Contains(t, s.Expr, `__stream_shard__="`+strconv.Itoa(i)+`"`)
+		assert.Equal(t, start, s.Start)
+		assert.Equal(t, end, s.End)
+	}
+}
+
+func TestShardQueries_TimeSplitFallback(t *testing.T) {
+	start := time.Unix(0, 0)
+	end := start.Add(time.Hour)
+	q := &lokiQuery{
+		Expr:      `sum(rate({job="app"}[5m]))`,
+		QueryType: QueryTypeRange,
+		Start:     start,
+		End:       end,
+	}
+
+	m := NewShardMapper(false)
+	plan, ok := m.Map(q, 4)
+	require.True(t, ok)
+
+	shards := shardQueries(q, plan)
+	require.Len(t, shards, 4)
+	assert.Equal(t, start, shards[0].Start)
+	assert.Equal(t, end, shards[len(shards)-1].End)
+	for i := 1; i < len(shards); i++ {
+		assert.Equal(t, shards[i-1].End, shards[i].Start)
+	}
+}
+
+func TestMergeRangeFrames_StreamShardReducesSameTimestamp(t *testing.T) {
+	q := &lokiQuery{QueryType: QueryTypeRange, Expr: `sum(rate({job="app"}[5m]))`}
+	plan := shardPlan{reducer: reducerSum, useStreamShard: true}
+
+	ts := time.Unix(100, 0)
+	frameSets := []data.Frames{
+		{rangeFrame("series", ts, 1)},
+		{rangeFrame("series", ts, 2)},
+	}
+
+	out, err := mergeRangeFrames(q, plan, frameSets)
+	require.NoError(t, err)
+	require.Len(t, out, 1)
+	require.Equal(t, 1, out[0].Fields[1].Len())
+	v, _ := out[0].Fields[1].FloatAt(0)
+	assert.Equal(t, 3.0, v, "stream-sharded shards reporting the same series+timestamp must be summed, not duplicated")
+}
+
+func TestMergeRangeFrames_TimeSplitConcatenatesDisjointWindows(t *testing.T) {
+	q := &lokiQuery{QueryType: QueryTypeRange, Expr: `sum(rate({job="app"}[5m]))`}
+	plan := shardPlan{reducer: reducerSum, useStreamShard: false}
+
+	frameSets := []data.Frames{
+		{rangeFrame("series", time.Unix(100, 0), 1)},
+		{rangeFrame("series", time.Unix(200, 0), 2)},
+	}
+
+	out, err := mergeRangeFrames(q, plan, frameSets)
+	require.NoError(t, err)
+	require.Len(t, out, 1)
+	require.Equal(t, 2, out[0].Fields[1].Len())
+}
+
+func rangeFrame(name string, ts time.Time, value float64) *data.Frame {
+	timeField := data.NewField("Time", nil, []time.Time{ts})
+	valueField := data.NewField("Value", nil, []float64{value})
+	return data.NewFrame(name, timeField, valueField)
+}
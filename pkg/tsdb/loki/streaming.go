@@ -0,0 +1,304 @@
+package loki
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
+	"github.com/xquare-dashboard/pkg/infra/log"
+)
+
+const (
+	tailPath            = "/loki/api/v1/tail"
+	tailReconnectMin    = 500 * time.Millisecond
+	tailReconnectMax    = 30 * time.Second
+	tailReconnectFactor = 2
+)
+
+// tailRequest is the JSON body of a `tail` stream subscription, e.g.
+// {"type":"tail","expr":"{job=\"app\"}","limit":100}.
+type tailRequest struct {
+	Type  string `json:"type"`
+	Expr  string `json:"expr"`
+	Limit int    `json:"limit"`
+}
+
+// tailFrame mirrors the payload Loki sends on /loki/api/v1/tail.
+type tailFrame struct {
+	Streams        []tailStreamEntry  `json:"streams"`
+	DroppedEntries []tailDroppedEntry `json:"dropped_entries"`
+}
+
+type tailStreamEntry struct {
+	Labels  string         `json:"labels"`
+	Entries []tailLogEntry `json:"entries"`
+}
+
+type tailLogEntry struct {
+	Timestamp time.Time `json:"ts"`
+	Line      string    `json:"line"`
+}
+
+type tailDroppedEntry struct {
+	Labels    string    `json:"labels"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (s *Service) SubscribeStream(ctx context.Context, req *backend.SubscribeStreamRequest) (*backend.SubscribeStreamResponse, error) {
+	plog := s.logger.FromContext(ctx)
+
+	tr, err := parseTailRequest(req.Data)
+	if err != nil {
+		plog.Error("Invalid tail subscription", "error", err, "path", req.Path)
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+	}
+	if tr.Type != "tail" || tr.Expr == "" {
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+	}
+
+	dsInfo, err := s.getDSInfo(ctx, req.PluginContext)
+	if err != nil {
+		return nil, err
+	}
+
+	dsInfo.streamsMu.Lock()
+	defer dsInfo.streamsMu.Unlock()
+	if _, ok := dsInfo.streams[req.Path]; !ok {
+		dsInfo.streams[req.Path] = data.FrameJSONCache{}
+	}
+
+	return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusOK}, nil
+}
+
+// PublishStream is not supported: tail streams are server-to-client only.
+func (s *Service) PublishStream(_ context.Context, _ *backend.PublishStreamRequest) (*backend.PublishStreamResponse, error) {
+	return &backend.PublishStreamResponse{Status: backend.PublishStreamStatusPermissionDenied}, nil
+}
+
+func (s *Service) RunStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
+	plog := s.logger.FromContext(ctx)
+
+	tr, err := parseTailRequest(req.Data)
+	if err != nil {
+		return err
+	}
+
+	dsInfo, err := s.getDSInfo(ctx, req.PluginContext)
+	if err != nil {
+		return err
+	}
+
+	refCount := subscriberRefCounter.add(req.Path)
+	defer func() {
+		if subscriberRefCounter.remove(req.Path) == 0 {
+			dsInfo.streamsMu.Lock()
+			delete(dsInfo.streams, req.Path)
+			dsInfo.streamsMu.Unlock()
+		}
+	}()
+	plog.Debug("Starting Loki tail stream", "path", req.Path, "subscribers", refCount)
+
+	lastSeen := time.Now()
+	backoffDelay := tailReconnectMin
+
+	for {
+		err := runTailOnce(ctx, dsInfo, tr, req.Path, &lastSeen, sender, plog)
+		if err == nil || ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		plog.Warn("Loki tail stream disconnected, reconnecting", "error", err, "backoff", backoffDelay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoffDelay):
+		}
+		backoffDelay *= tailReconnectFactor
+		if backoffDelay > tailReconnectMax {
+			backoffDelay = tailReconnectMax
+		}
+	}
+}
+
+// runTailOnce opens a single websocket connection to Loki's tail endpoint
+// and forwards frames to sender until the connection closes or ctx is
+// cancelled. lastSeen is advanced as entries arrive so a reconnect resumes
+// from last_seen_ts+1ns instead of replaying already-sent lines.
+func runTailOnce(ctx context.Context, dsInfo *datasourceInfo, tr *tailRequest, streamPath string, lastSeen *time.Time, sender *backend.StreamSender, plog log.Logger) error {
+	wsURL, err := buildTailURL(dsInfo.URL, tr, *lastSeen)
+	if err != nil {
+		return err
+	}
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to dial loki tail endpoint: %w", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		var frame tailFrame
+		if err := json.Unmarshal(msg, &frame); err != nil {
+			plog.Error("Failed to decode loki tail frame", "error", err)
+			continue
+		}
+
+		df, notices, newest := tailFrameToDataFrame(frame)
+		if newest.After(*lastSeen) {
+			*lastSeen = newest
+		}
+		if len(notices) > 0 {
+			df.Meta = &data.FrameMeta{Notices: notices}
+		}
+
+		if err := sendCachedFrame(dsInfo, streamPath, df, sender); err != nil {
+			return err
+		}
+	}
+}
+
+// sendCachedFrame sends df through sender, reusing the cached JSON schema
+// for streamPath so only the data portion needs to be sent after the first
+// frame, per data.FrameJSONCache.
+func sendCachedFrame(dsInfo *datasourceInfo, streamPath string, df *data.Frame, sender *backend.StreamSender) error {
+	dsInfo.streamsMu.Lock()
+	prev := dsInfo.streams[streamPath]
+	dsInfo.streamsMu.Unlock()
+
+	next, err := data.FrameToJSONCache(df)
+	if err != nil {
+		return err
+	}
+	// Reuse the previous schema bytes when unchanged so we only ship the
+	// data portion of the packet, as FrameJSONCache intends.
+	sameSchema := prev.SameSchema(&next)
+	if sameSchema {
+		next.Schema = prev.Schema
+	}
+
+	dsInfo.streamsMu.Lock()
+	dsInfo.streams[streamPath] = next
+	dsInfo.streamsMu.Unlock()
+
+	include := data.IncludeAll
+	if sameSchema {
+		include = data.IncludeDataOnly
+	}
+	return sender.SendFrame(df, include)
+}
+
+func tailFrameToDataFrame(frame tailFrame) (*data.Frame, []data.Notice, time.Time) {
+	var newest time.Time
+
+	labelsField := data.NewFieldFromFieldType(data.FieldTypeString, 0)
+	labelsField.Name = "labels"
+	timeField := data.NewFieldFromFieldType(data.FieldTypeTime, 0)
+	timeField.Name = "Time"
+	lineField := data.NewFieldFromFieldType(data.FieldTypeString, 0)
+	lineField.Name = "Line"
+
+	for _, stream := range frame.Streams {
+		for _, entry := range stream.Entries {
+			labelsField.Append(stream.Labels)
+			timeField.Append(entry.Timestamp)
+			lineField.Append(entry.Line)
+			if entry.Timestamp.After(newest) {
+				newest = entry.Timestamp
+			}
+		}
+	}
+
+	df := data.NewFrame("tail", labelsField, timeField, lineField)
+
+	var notices []data.Notice
+	if len(frame.DroppedEntries) > 0 {
+		notices = append(notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("loki dropped %d log entries while tailing", len(frame.DroppedEntries)),
+		})
+	}
+
+	return df, notices, newest
+}
+
+func buildTailURL(baseURL string, tr *tailRequest, since time.Time) (string, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid datasource URL: %w", err)
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + tailPath
+
+	q := u.Query()
+	q.Set("query", tr.Expr)
+	if tr.Limit > 0 {
+		q.Set("limit", strconv.Itoa(tr.Limit))
+	}
+	if !since.IsZero() {
+		q.Set("start", strconv.FormatInt(since.Add(time.Nanosecond).UnixNano(), 10))
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+func parseTailRequest(raw json.RawMessage) (*tailRequest, error) {
+	tr := &tailRequest{}
+	if err := json.Unmarshal(raw, tr); err != nil {
+		return nil, fmt.Errorf("invalid stream subscription payload: %w", err)
+	}
+	return tr, nil
+}
+
+// refCounter tracks the number of active RunStream calls per stream path.
+// When the last one returns, RunStream drops that path's cached frame schema
+// from datasourceInfo.streams. Each RunStream call dials its own upstream
+// Loki websocket; connections are not shared between calls.
+type refCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var subscriberRefCounter = &refCounter{counts: make(map[string]int)}
+
+func (r *refCounter) add(key string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[key]++
+	return r.counts[key]
+}
+
+func (r *refCounter) remove(key string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[key]--
+	n := r.counts[key]
+	if n <= 0 {
+		delete(r.counts, key)
+	}
+	return n
+}
@@ -0,0 +1,76 @@
+package loki
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildTailURL(t *testing.T) {
+	tr := &tailRequest{Type: "tail", Expr: `{job="app"}`, Limit: 100}
+	since := time.Unix(100, 0)
+
+	u, err := buildTailURL("https://loki.example.com/", tr, since)
+	require.NoError(t, err)
+	assert.Contains(t, u, "wss://loki.example.com/loki/api/v1/tail")
+	assert.Contains(t, u, "query=")
+	assert.Contains(t, u, "limit=100")
+	assert.Contains(t, u, "start=")
+}
+
+func TestBuildTailURL_NoLimitNoSince(t *testing.T) {
+	tr := &tailRequest{Type: "tail", Expr: `{job="app"}`}
+
+	u, err := buildTailURL("http://loki.example.com", tr, time.Time{})
+	require.NoError(t, err)
+	assert.Contains(t, u, "ws://loki.example.com/loki/api/v1/tail")
+	assert.NotContains(t, u, "start=")
+	assert.NotContains(t, u, "limit=")
+}
+
+func TestTailFrameToDataFrame(t *testing.T) {
+	frame := tailFrame{
+		Streams: []tailStreamEntry{
+			{
+				Labels: `{job="app"}`,
+				Entries: []tailLogEntry{
+					{Timestamp: time.Unix(1, 0), Line: "first"},
+					{Timestamp: time.Unix(2, 0), Line: "second"},
+				},
+			},
+		},
+		DroppedEntries: []tailDroppedEntry{
+			{Labels: `{job="app"}`, Timestamp: time.Unix(3, 0)},
+		},
+	}
+
+	df, notices, newest := tailFrameToDataFrame(frame)
+	require.Len(t, df.Fields, 3)
+	assert.Equal(t, 2, df.Fields[0].Len())
+	assert.Equal(t, time.Unix(2, 0), newest)
+	require.Len(t, notices, 1)
+	assert.Equal(t, "loki dropped 1 log entries while tailing", notices[0].Text)
+}
+
+func TestRefCounter(t *testing.T) {
+	rc := &refCounter{counts: make(map[string]int)}
+
+	assert.Equal(t, 1, rc.add("a"))
+	assert.Equal(t, 2, rc.add("a"))
+	assert.Equal(t, 1, rc.remove("a"))
+	assert.Equal(t, 0, rc.remove("a"))
+	assert.NotContains(t, rc.counts, "a")
+}
+
+func TestParseTailRequest(t *testing.T) {
+	tr, err := parseTailRequest([]byte(`{"type":"tail","expr":"{job=\"app\"}","limit":50}`))
+	require.NoError(t, err)
+	assert.Equal(t, "tail", tr.Type)
+	assert.Equal(t, `{job="app"}`, tr.Expr)
+	assert.Equal(t, 50, tr.Limit)
+
+	_, err = parseTailRequest([]byte(`not json`))
+	require.Error(t, err)
+}
@@ -0,0 +1,46 @@
+package loki
+
+import (
+	"regexp"
+	"time"
+)
+
+// QueryType distinguishes a Loki query's shape, mirroring the "queryType"
+// field Grafana's Loki datasource sends on the wire.
+type QueryType string
+
+const (
+	QueryTypeRange   QueryType = "range"
+	QueryTypeInstant QueryType = "instant"
+	QueryTypeStream  QueryType = "stream"
+)
+
+// Loki's log-line direction values, lowercase as sent by the datasource and
+// returned in the API response (not Go constants of the enquiry frontend).
+const (
+	directionBackward = "backward"
+	directionForward  = "forward"
+)
+
+// lokiQuery is the request shape runQuery/ShardMapper operate on, parsed out
+// of the raw QueryJSONModel by parseQuery.
+type lokiQuery struct {
+	Expr      string
+	QueryType QueryType
+	Direction string
+	RefID     string
+	Start     time.Time
+	End       time.Time
+	// Shards overrides the datasource's default shard count for this
+	// query; 0 means "use the datasource default".
+	Shards int
+}
+
+var aggregationCallRe = regexp.MustCompile(`\b(sum|min|max|count|topk|bottomk|avg|stddev|stdvar|absent|quantile_over_time)\s*\(`)
+
+// isLogQuery reports whether q selects raw log lines rather than a metric
+// aggregation, i.e. its expression has no outer aggregation or range-vector
+// function wrapping it.
+func (q *lokiQuery) isLogQuery() bool {
+	return !aggregationCallRe.MatchString(q.Expr) && !rangeVectorFuncs.MatchString(q.Expr)
+}
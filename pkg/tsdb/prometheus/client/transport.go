@@ -9,6 +9,7 @@ import (
 	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/xquare-dashboard/pkg/infra/httpclient/httpclientprovider"
 	"github.com/xquare-dashboard/pkg/tsdb/prometheus/middleware"
 	"github.com/xquare-dashboard/pkg/tsdb/prometheus/utils"
 	"github.com/xquare-dashboard/pkg/util/maputil"
@@ -43,6 +44,8 @@ func middlewares(logger log.Logger, httpMethod string) []sdkhttpclient.Middlewar
 		// TODO: probably isn't needed anymore and should by done by http infra code
 		middleware.CustomQueryParameters(logger),
 		sdkhttpclient.CustomHeadersMiddleware(),
+		httpclientprovider.RetryMiddleware(httpclientprovider.DefaultRetryConfig()),
+		httpclientprovider.CacheMiddleware(httpclientprovider.DefaultCacheConfig(), nil),
 	}
 
 	// Needed to control GET vs POST method of the requests